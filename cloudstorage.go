@@ -3,6 +3,8 @@ package storage
 import (
 	"fmt"
 	"io"
+	"net/url"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
@@ -20,6 +22,18 @@ import (
 // file storage.
 type CloudStorage struct {
 	Bucket string // Bucket is the name of the bucket to use as the underlying storage.
+
+	// Encryption, if set, configures customer-managed encryption (CMEK) for
+	// objects written via Create.
+	Encryption *GCSEncryption
+}
+
+// GCSEncryption configures Google Cloud Storage customer-managed encryption.
+type GCSEncryption struct {
+	// KMSKeyName is the Cloud KMS key resource ID
+	// ("projects/P/locations/L/keyRings/R/cryptoKeys/K") used to encrypt
+	// objects written via Create.
+	KMSKeyName string
 }
 
 var _ FS = (*CloudStorage)(nil)
@@ -49,13 +63,50 @@ func (c *CloudStorage) Open(ctx context.Context, path string) (*File, error) {
 	}, nil
 }
 
-// Create implements FS.
-func (c *CloudStorage) Create(ctx context.Context, path string) (io.WriteCloser, error) {
-	b, err := c.blobBucketHandle(ctx)
+// Create implements FS. When opts specifies a ChunkSize, it is used as the
+// underlying writer's buffer/chunk size, matching the semantics of
+// storage.Writer.ChunkSize.
+func (c *CloudStorage) Create(ctx context.Context, path string, opts ...*CreateOptions) (io.WriteCloser, error) {
+	o := firstCreateOptions(opts)
+
+	bh, err := c.bucketHandle(ctx, storage.ScopeReadWrite)
 	if err != nil {
 		return nil, err
 	}
-	return b.NewWriter(ctx, path, nil)
+
+	ow := bh.Object(path).NewWriter(ctx)
+	if o.ChunkSize > 0 {
+		ow.ChunkSize = o.ChunkSize
+	}
+	if len(o.ContentType) > 0 {
+		ow.ContentType = o.ContentType
+	}
+	if len(o.CacheControl) > 0 {
+		ow.CacheControl = o.CacheControl
+	}
+	if len(o.ContentEncoding) > 0 {
+		ow.ContentEncoding = o.ContentEncoding
+	}
+	if len(o.Metadata) > 0 {
+		ow.Metadata = o.Metadata
+	}
+	if c.Encryption != nil && len(c.Encryption.KMSKeyName) > 0 {
+		ow.KMSKeyName = c.Encryption.KMSKeyName
+	}
+
+	return ow, nil
+}
+
+// Download fetches the object at path and writes it to w. Unlike S3,
+// cloud.google.com/go/storage has no equivalent of ranged, concurrent
+// downloads, so this simply streams the object via Open.
+func (c *CloudStorage) Download(ctx context.Context, path string, w io.Writer, opts ...*DownloadOptions) (int64, error) {
+	f, err := c.Open(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
 }
 
 // Delete implements FS.
@@ -69,14 +120,42 @@ func (c *CloudStorage) Delete(ctx context.Context, path string) error {
 
 // Walk implements FS.
 func (c *CloudStorage) Walk(ctx context.Context, path string, fn WalkFn) error {
+	return c.WalkFull(ctx, path, nil, func(oi ObjectInfo) error {
+		return fn(oi.Name)
+	})
+}
+
+// WalkFull implements FS.
+func (c *CloudStorage) WalkFull(ctx context.Context, path string, opts *WalkOptions, fn ObjectInfoFn) error {
+	opts = walkOptionsOrDefault(opts)
+
 	bh, err := c.bucketHandle(ctx, storage.ScopeReadOnly)
 	if err != nil {
 		return err
 	}
 
-	it := bh.Objects(ctx, &storage.Query{
-		Prefix: path,
-	})
+	startOffset := opts.StartAfter
+	if len(startOffset) > 0 {
+		// WalkOptions.StartAfter is documented as exclusive, matching S3's
+		// StartAfter, but GCS's StartOffset is inclusive. Appending a NUL
+		// byte advances past the boundary key, since key+"\x00" sorts
+		// immediately after the key itself and before any other key that
+		// has it as a prefix.
+		startOffset += "\x00"
+	}
+
+	q := &storage.Query{
+		Prefix:      path,
+		StartOffset: startOffset,
+	}
+	if len(opts.Delimiter) > 0 && !opts.Recursive {
+		q.Delimiter = opts.Delimiter
+	}
+
+	it := bh.Objects(ctx, q)
+	if opts.PageSize > 0 {
+		it.PageInfo().MaxSize = opts.PageSize
+	}
 
 	for {
 		r, err := it.Next()
@@ -88,13 +167,90 @@ func (c *CloudStorage) Walk(ctx context.Context, path string, fn WalkFn) error {
 			return err
 		}
 
-		if err = fn(r.Name); err != nil {
+		// A non-empty Prefix means this entry is a synthetic "directory"
+		// grouped by Delimiter, not a real object; Name is empty in that
+		// case.
+		if len(r.Prefix) > 0 {
+			if err = fn(ObjectInfo{Name: r.Prefix, IsPrefix: true}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = fn(ObjectInfo{
+			Name:         r.Name,
+			Size:         r.Size,
+			ModTime:      r.Updated,
+			ETag:         r.Etag,
+			StorageClass: r.StorageClass,
+			ContentType:  r.ContentType,
+		}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// SignedURL implements URLSigner. It signs with the default service
+// account's private key, derived from the application default credentials.
+func (c *CloudStorage) SignedURL(ctx context.Context, path string, opts *SignedURLOptions) (string, error) {
+	o := signedURLOptionsOrDefault(opts)
+
+	dc, err := gcp.DefaultCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	jwtConf, err := google.JWTConfigFromJSON(dc.JSON)
+	if err != nil {
+		return "", fmt.Errorf("cloud storage: unable to derive a signer from the default credentials: %v", err)
+	}
+
+	qp := url.Values{}
+	if len(o.ResponseContentDisposition) > 0 {
+		qp.Set("response-content-disposition", o.ResponseContentDisposition)
+	}
+	if len(o.ResponseContentType) > 0 {
+		qp.Set("response-content-type", o.ResponseContentType)
+	}
+
+	signed, err := storage.SignedURL(c.Bucket, path, &storage.SignedURLOptions{
+		GoogleAccessID:  jwtConf.Email,
+		PrivateKey:      jwtConf.PrivateKey,
+		Method:          o.Method,
+		Expires:         time.Now().Add(o.Expiry),
+		ContentType:     o.ContentType,
+		QueryParameters: qp,
+	})
+	if err != nil {
+		return "", fmt.Errorf("cloud storage: unable to sign url: %v", err)
+	}
+	return signed, nil
+}
+
+// Copy implements FS using GCS's Rewrite API, exposed by the client library
+// as ObjectHandle.CopierFrom. Run makes repeated rewrite RPCs under the hood,
+// resuming from the returned rewrite token until the copy completes, which
+// GCS requires for large objects or copies that cross location/class.
+func (c *CloudStorage) Copy(ctx context.Context, src, dst string) error {
+	bh, err := c.bucketHandle(ctx, storage.ScopeReadWrite)
+	if err != nil {
+		return fmt.Errorf("cloud storage: unable to copy %q to %q: %v", src, dst, err)
+	}
+
+	if _, err := bh.Object(dst).CopierFrom(bh.Object(src)).Run(ctx); err != nil {
+		return fmt.Errorf("cloud storage: unable to copy %q to %q: %v", src, dst, err)
+	}
+	return nil
+}
+
+// Move implements FS by copying src to dst and then deleting src.
+func (c *CloudStorage) Move(ctx context.Context, src, dst string) error {
+	if err := c.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	return c.Delete(ctx, src)
+}
+
 func (c *CloudStorage) blobBucketHandle(ctx context.Context) (*blob.Bucket, error) {
 	dc, err := gcp.DefaultCredentials(ctx)
 	if err != nil {
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKEK(t *testing.T) []byte {
+	t.Helper()
+	return bytes.Repeat([]byte{0x42}, dekSize)
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	kek := testKEK(t)
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+
+	ciphertext, err := seal(kek, plaintext)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	got, err := open(kek, ciphertext)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("open returned %q, want %q", got, plaintext)
+	}
+}
+
+func TestSealOpenEmptyPlaintext(t *testing.T) {
+	kek := testKEK(t)
+
+	ciphertext, err := seal(kek, nil)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	got, err := open(kek, ciphertext)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("open returned %q, want empty", got)
+	}
+}
+
+func TestOpenRejectsTamperedCiphertext(t *testing.T) {
+	kek := testKEK(t)
+
+	ciphertext, err := seal(kek, []byte("secret"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	tampered := make([]byte, len(ciphertext))
+	copy(tampered, ciphertext)
+	tampered[len(tampered)-1] ^= 0xff // flip a byte in the sealed body/tag
+
+	if _, err := open(kek, tampered); err == nil {
+		t.Fatal("open accepted tampered ciphertext, want error")
+	}
+}
+
+func TestOpenRejectsWrongKEK(t *testing.T) {
+	kek := testKEK(t)
+	other := bytes.Repeat([]byte{0x24}, dekSize)
+
+	ciphertext, err := seal(kek, []byte("secret"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	if _, err := open(other, ciphertext); err == nil {
+		t.Fatal("open accepted wrong KEK, want error")
+	}
+}
+
+func TestOpenRejectsShortBuffer(t *testing.T) {
+	kek := testKEK(t)
+
+	if _, err := open(kek, []byte("too short")); err == nil {
+		t.Fatal("open accepted a too-short buffer, want error")
+	}
+	if _, err := open(kek, nil); err == nil {
+		t.Fatal("open accepted an empty buffer, want error")
+	}
+}
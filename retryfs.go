@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"google.golang.org/api/googleapi"
+)
+
+// RetryConfig controls the retry/backoff policy applied by RetryFS.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts made for an operation,
+	// including the first. A value <= 1 disables retries.
+	MaxAttempts int
+
+	// InitialBackoff is the base delay before the first retry, doubled on
+	// each subsequent attempt. Defaults to 100ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between retries. Defaults to 30s.
+	MaxBackoff time.Duration
+
+	// Jitter, if true, applies "full jitter": each delay is chosen uniformly
+	// at random between 0 and the computed exponential backoff, rather than
+	// using the backoff as-is.
+	Jitter bool
+
+	// RetryOn reports whether err should be retried. If nil, IsRetryable is
+	// used, which classifies S3 and GCS throttling/5xx errors as retryable.
+	RetryOn func(error) bool
+}
+
+func retryConfigOrDefault(cfg RetryConfig) RetryConfig {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.RetryOn == nil {
+		cfg.RetryOn = IsRetryable
+	}
+	return cfg
+}
+
+// IsRetryable reports whether err looks like a transient failure worth
+// retrying: for S3, 429s, 5xx responses and the RequestTimeout, SlowDown,
+// Throttling, ThrottlingException and RequestLimitExceeded error codes; for
+// GCS, 429s and 5xx responses.
+func IsRetryable(err error) bool {
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		switch rf.Code() {
+		case "RequestTimeout", "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return true
+		}
+		return rf.StatusCode() == 429 || rf.StatusCode() >= 500
+	}
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code == 429 || gerr.Code >= 500
+	}
+	return false
+}
+
+// RetryFS wraps another FS with a retry policy, an optional rate limiter and
+// metrics hooks, so that transient throttling from the underlying backend
+// doesn't surface as a hard failure and its behaviour can be observed by
+// operators.
+type RetryFS struct {
+	FS FS
+
+	// Retry is the retry/backoff policy applied to each operation. The zero
+	// value disables retries.
+	Retry RetryConfig
+
+	// Limiter, if set, is waited on before each attempt of an operation,
+	// capping the rate at which requests reach FS.
+	Limiter *rate.Limiter
+
+	// OnRequest, if set, is called before each attempt of an operation.
+	OnRequest func(op, path string)
+
+	// OnRetry, if set, is called once an attempt has failed with a retryable
+	// error, after the backoff before the next attempt has been chosen.
+	OnRetry func(op, path string, attempt int, err error, backoff time.Duration)
+
+	// OnError, if set, is called once an operation fails with a
+	// non-retryable error, or after its final attempt is exhausted.
+	OnError func(op, path string, err error)
+}
+
+var _ FS = (*RetryFS)(nil)
+
+// Open implements FS.
+func (r *RetryFS) Open(ctx context.Context, path string) (*File, error) {
+	var f *File
+	err := r.do(ctx, "Open", path, func() (err error) {
+		f, err = r.FS.Open(ctx, path)
+		return err
+	})
+	return f, err
+}
+
+// Create implements FS.
+func (r *RetryFS) Create(ctx context.Context, path string, opts ...*CreateOptions) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	err := r.do(ctx, "Create", path, func() (err error) {
+		w, err = r.FS.Create(ctx, path, opts...)
+		return err
+	})
+	return w, err
+}
+
+// Delete implements FS.
+func (r *RetryFS) Delete(ctx context.Context, path string) error {
+	return r.do(ctx, "Delete", path, func() error {
+		return r.FS.Delete(ctx, path)
+	})
+}
+
+// Walk implements FS. A retried Walk restarts from the beginning of path, so
+// fn may be called more than once for files visited before the failure.
+func (r *RetryFS) Walk(ctx context.Context, path string, fn WalkFn) error {
+	return r.do(ctx, "Walk", path, func() error {
+		return r.FS.Walk(ctx, path, fn)
+	})
+}
+
+// WalkFull implements FS. As with Walk, a retried WalkFull restarts from the
+// beginning of path.
+func (r *RetryFS) WalkFull(ctx context.Context, path string, opts *WalkOptions, fn ObjectInfoFn) error {
+	return r.do(ctx, "WalkFull", path, func() error {
+		return r.FS.WalkFull(ctx, path, opts, fn)
+	})
+}
+
+// Copy implements FS.
+func (r *RetryFS) Copy(ctx context.Context, src, dst string) error {
+	return r.do(ctx, "Copy", src, func() error {
+		return r.FS.Copy(ctx, src, dst)
+	})
+}
+
+// Move implements FS.
+func (r *RetryFS) Move(ctx context.Context, src, dst string) error {
+	return r.do(ctx, "Move", src, func() error {
+		return r.FS.Move(ctx, src, dst)
+	})
+}
+
+// do runs fn, retrying according to r.Retry and waiting on r.Limiter (if
+// set) before each attempt, reporting progress via r.OnRequest, r.OnRetry and
+// r.OnError.
+func (r *RetryFS) do(ctx context.Context, op, path string, fn func() error) error {
+	cfg := retryConfigOrDefault(r.Retry)
+
+	var err error
+	for attempt := 1; attempt <= cfg.MaxAttempts; attempt++ {
+		if r.Limiter != nil {
+			if werr := r.Limiter.Wait(ctx); werr != nil {
+				return fmt.Errorf("storage: rate limiter: %v", werr)
+			}
+		}
+		if r.OnRequest != nil {
+			r.OnRequest(op, path)
+		}
+
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if attempt == cfg.MaxAttempts || !cfg.RetryOn(err) {
+			if r.OnError != nil {
+				r.OnError(op, path, err)
+			}
+			return err
+		}
+
+		backoff := cfg.backoff(attempt)
+		if r.OnRetry != nil {
+			r.OnRetry(op, path, attempt, err, backoff)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// backoff returns the delay before the given attempt (1-indexed) is retried:
+// InitialBackoff doubled once per prior attempt, capped at MaxBackoff, and
+// optionally randomized with full jitter.
+func (cfg RetryConfig) backoff(attempt int) time.Duration {
+	d := cfg.InitialBackoff * time.Duration(uint64(1)<<uint(attempt-1))
+	if d <= 0 || d > cfg.MaxBackoff {
+		d = cfg.MaxBackoff
+	}
+	if cfg.Jitter {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	return d
+}
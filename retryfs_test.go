@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"s3 throttling code", awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "req-1"), true},
+		{"s3 request timeout code", awserr.NewRequestFailure(awserr.New("RequestTimeout", "timed out", nil), 400, "req-2"), true},
+		{"s3 429", awserr.NewRequestFailure(awserr.New("TooManyRequests", "too many", nil), 429, "req-3"), true},
+		{"s3 5xx", awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "req-4"), true},
+		{"s3 not found is not retryable", awserr.NewRequestFailure(awserr.New("NoSuchKey", "missing", nil), 404, "req-5"), false},
+		{"gcs 429", &googleapi.Error{Code: 429}, true},
+		{"gcs 5xx", &googleapi.Error{Code: 503}, true},
+		{"gcs 4xx is not retryable", &googleapi.Error{Code: 403}, false},
+		{"unrecognized error is not retryable", errString("boom"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+type errString string
+
+func (e errString) Error() string { return string(e) }
+
+func TestRetryConfigBackoff(t *testing.T) {
+	cfg := retryConfigOrDefault(RetryConfig{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+	})
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, 1 * time.Second},  // would be 1.6s uncapped, clamped to MaxBackoff
+		{20, 1 * time.Second}, // far past the cap (100ms<<19) also clamps to MaxBackoff
+	}
+
+	for _, tt := range tests {
+		if got := cfg.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryConfigBackoffJitter(t *testing.T) {
+	cfg := retryConfigOrDefault(RetryConfig{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+		Jitter:         true,
+	})
+
+	for i := 0; i < 20; i++ {
+		d := cfg.backoff(3)
+		if d < 0 || d > 400*time.Millisecond {
+			t.Fatalf("backoff(3) with jitter = %v, want in [0, 400ms]", d)
+		}
+	}
+}
@@ -3,12 +3,15 @@ package storage
 import (
 	"fmt"
 	"io"
+	"net/url"
 
 	"golang.org/x/net/context"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -17,21 +20,110 @@ import (
 	"github.com/google/go-cloud/blob/s3blob"
 )
 
+// s3CopyObjectMaxSize is the largest object CopyObject can copy in a single
+// request. Larger objects must be copied part-by-part with UploadPartCopy
+// instead.
+const s3CopyObjectMaxSize = 5 * 1024 * 1024 * 1024 // 5GB
+
 // S3 is an implementation of FS which uses AWS S3 as the underlying storage layer.
 type S3 struct {
 	Bucket string // Bucket is the name of the bucket to use as the underlying storage.
+
+	// Endpoint overrides the default AWS S3 endpoint, allowing S3 to be pointed
+	// at S3-compatible services such as Localstack, MinIO or Ceph RadosGW. When
+	// empty, the default AWS endpoint for Region is used.
+	Endpoint string
+
+	// Region is the AWS region (or S3-compatible service region) the bucket
+	// lives in. If empty, the session's configured region is used; if that is
+	// also empty, the region is discovered via GetBucketRegion when Endpoint
+	// is empty, and defaults to us-east-1 otherwise.
+	Region string
+
+	// Profile is the name of the shared credentials profile to use. It is
+	// ignored if Credentials is set.
+	Profile string
+
+	// Credentials, if set, is used in place of the default environment based
+	// credential chain (or Profile, if set).
+	Credentials credentials.Provider
+
+	// ForcePathStyle forces bucket-in-path addressing (bucket.s3.amazonaws.com
+	// becomes s3.amazonaws.com/bucket), which most S3-compatible services
+	// require.
+	ForcePathStyle bool
+
+	// DisableSSL disables the use of HTTPS when talking to Endpoint, useful
+	// for local S3-compatible services running without TLS.
+	DisableSSL bool
+
+	// Encryption, if set, configures server-side encryption for objects
+	// written via Create and read via Open/Download.
+	Encryption *S3Encryption
+}
+
+// S3Encryption configures S3 server-side encryption: SSE-S3 (AES256), SSE-KMS
+// or SSE-C (customer-supplied keys).
+type S3Encryption struct {
+	// SSEAlgorithm is the server-side encryption algorithm to request, e.g.
+	// "AES256" for SSE-S3 or "aws:kms" for SSE-KMS. Ignored if CustomerKey is
+	// set.
+	SSEAlgorithm string
+
+	// KMSKeyID is the KMS key ID (or ARN) to encrypt with when SSEAlgorithm is
+	// "aws:kms". If empty, the bucket's default KMS key is used.
+	KMSKeyID string
+
+	// CustomerKey, if set, enables SSE-C: the raw 256-bit key used to encrypt
+	// and decrypt the object. S3 does not store this key.
+	CustomerKey []byte
+}
+
+// writeHeaders returns the request fields needed to write an object under
+// this encryption configuration.
+func (e *S3Encryption) writeHeaders() (sse, kmsKeyID, sseCAlgorithm, sseCKey *string) {
+	if e == nil {
+		return nil, nil, nil, nil
+	}
+	if len(e.CustomerKey) > 0 {
+		return nil, nil, aws.String("AES256"), aws.String(string(e.CustomerKey))
+	}
+	if len(e.SSEAlgorithm) > 0 {
+		sse = aws.String(e.SSEAlgorithm)
+	}
+	if len(e.KMSKeyID) > 0 {
+		kmsKeyID = aws.String(e.KMSKeyID)
+	}
+	return sse, kmsKeyID, nil, nil
+}
+
+// readHeaders returns the request fields needed to read an SSE-C encrypted
+// object.
+func (e *S3Encryption) readHeaders() (sseCAlgorithm, sseCKey *string) {
+	if e == nil || len(e.CustomerKey) == 0 {
+		return nil, nil
+	}
+	return aws.String("AES256"), aws.String(string(e.CustomerKey))
 }
 
 // Open implements FS.
 func (s *S3) Open(ctx context.Context, path string) (*File, error) {
-	b, _, err := s.bucketHandles(ctx)
+	// Opening via the raw s3 client (rather than the blob abstraction used
+	// elsewhere) so that SSE-C customer keys can be attached to the request.
+	_, s3c, err := s.bucketHandles(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := b.NewReader(ctx, path)
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(path),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.Encryption.readHeaders()
+
+	out, err := s3c.GetObjectWithContext(ctx, input)
 	if err != nil {
-		if blob.IsNotExist(err) {
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
 			return nil, &notExistError{
 				Path: path,
 			}
@@ -39,21 +131,167 @@ func (s *S3) Open(ctx context.Context, path string) (*File, error) {
 		return nil, fmt.Errorf("s3: unable to fetch object: %v", err)
 	}
 
-	// XXX(@benhinchley): https://github.com/google/go-cloud/pull/240
 	return &File{
-		ReadCloser: f,
+		ReadCloser: out.Body,
 		Name:       path,
-		Size:       f.Size(),
+		Size:       aws.Int64Value(out.ContentLength),
+		ModTime:    aws.TimeValue(out.LastModified),
 	}, nil
 }
 
-// Create implements FS.
-func (s *S3) Create(ctx context.Context, path string) (io.WriteCloser, error) {
-	b, _, err := s.bucketHandles(ctx)
+// Create implements FS. When opts specifies a ChunkSize and/or Concurrency,
+// the object is streamed to S3 in parts of that size using s3manager.Uploader
+// so that multi-GB objects can be written without buffering the whole object
+// in memory.
+func (s *S3) Create(ctx context.Context, path string, opts ...*CreateOptions) (io.WriteCloser, error) {
+	o := firstCreateOptions(opts)
+
+	sess, c, err := s.awsConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return b.NewWriter(ctx, path, nil)
+
+	uploader := s3manager.NewUploader(sess.Copy(c), func(u *s3manager.Uploader) {
+		if o.ChunkSize > 0 {
+			u.PartSize = int64(o.ChunkSize)
+		}
+		if o.Concurrency > 0 {
+			u.Concurrency = o.Concurrency
+		}
+	})
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(path),
+	}
+	if len(o.ContentType) > 0 {
+		input.ContentType = aws.String(o.ContentType)
+	}
+	if len(o.CacheControl) > 0 {
+		input.CacheControl = aws.String(o.CacheControl)
+	}
+	if len(o.ContentEncoding) > 0 {
+		input.ContentEncoding = aws.String(o.ContentEncoding)
+	}
+	if len(o.Metadata) > 0 {
+		input.Metadata = make(map[string]*string, len(o.Metadata))
+		for k, v := range o.Metadata {
+			input.Metadata[k] = aws.String(v)
+		}
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId, input.SSECustomerAlgorithm, input.SSECustomerKey = s.Encryption.writeHeaders()
+
+	pr, pw := io.Pipe()
+	input.Body = pr
+
+	w := &s3UploadWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := uploader.UploadWithContext(ctx, input)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// Download fetches the object at path into w, splitting the fetch into
+// concurrent ranged GETs via s3manager.Downloader. It returns the number of
+// bytes read.
+func (s *S3) Download(ctx context.Context, path string, w io.WriterAt, opts ...*DownloadOptions) (int64, error) {
+	o := firstDownloadOptions(opts)
+
+	sess, c, err := s.awsConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	downloader := s3manager.NewDownloader(sess.Copy(c), func(d *s3manager.Downloader) {
+		if o.ChunkSize > 0 {
+			d.PartSize = int64(o.ChunkSize)
+		}
+		if o.Concurrency > 0 {
+			d.Concurrency = o.Concurrency
+		}
+	})
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(path),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = s.Encryption.readHeaders()
+
+	n, err := downloader.DownloadWithContext(ctx, w, input)
+	if err != nil {
+		return n, fmt.Errorf("s3: unable to download object: %v", err)
+	}
+	return n, nil
+}
+
+// SignedURL implements URLSigner.
+func (s *S3) SignedURL(ctx context.Context, path string, opts *SignedURLOptions) (string, error) {
+	o := signedURLOptionsOrDefault(opts)
+
+	_, s3c, err := s.bucketHandles(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var req *request.Request
+	switch o.Method {
+	case "GET":
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(path),
+		}
+		if len(o.ResponseContentDisposition) > 0 {
+			input.ResponseContentDisposition = aws.String(o.ResponseContentDisposition)
+		}
+		if len(o.ResponseContentType) > 0 {
+			input.ResponseContentType = aws.String(o.ResponseContentType)
+		}
+		req, _ = s3c.GetObjectRequest(input)
+	case "PUT":
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(path),
+		}
+		if len(o.ContentType) > 0 {
+			input.ContentType = aws.String(o.ContentType)
+		}
+		req, _ = s3c.PutObjectRequest(input)
+	case "DELETE":
+		req, _ = s3c.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(path),
+		})
+	default:
+		return "", fmt.Errorf("s3: unsupported signed URL method %q", o.Method)
+	}
+
+	url, err := req.Presign(o.Expiry)
+	if err != nil {
+		return "", fmt.Errorf("s3: unable to presign request: %v", err)
+	}
+	return url, nil
+}
+
+// s3UploadWriter adapts the synchronous s3manager.Uploader API to the
+// io.WriteCloser interface expected by Create, by streaming writes through a
+// pipe into the in-flight upload.
+type s3UploadWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3UploadWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3UploadWriter) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
 }
 
 // Delete implements FS.
@@ -67,18 +305,53 @@ func (s *S3) Delete(ctx context.Context, path string) error {
 
 // Walk implements FS.
 func (s *S3) Walk(ctx context.Context, path string, fn WalkFn) error {
+	return s.WalkFull(ctx, path, nil, func(oi ObjectInfo) error {
+		return fn(oi.Name)
+	})
+}
+
+// WalkFull implements FS.
+func (s *S3) WalkFull(ctx context.Context, path string, opts *WalkOptions, fn ObjectInfoFn) error {
+	opts = walkOptionsOrDefault(opts)
+
 	_, s3c, err := s.bucketHandles(ctx)
 	if err != nil {
 		return err
 	}
-	errCh := make(chan error, 1)
 
-	err = s3c.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.Bucket),
 		Prefix: aws.String(path),
-	}, func(page *s3.ListObjectsOutput, last bool) bool {
+	}
+	if delim := opts.Delimiter; len(delim) > 0 && !opts.Recursive {
+		input.Delimiter = aws.String(delim)
+	}
+	if len(opts.StartAfter) > 0 {
+		input.StartAfter = aws.String(opts.StartAfter)
+	}
+	if opts.PageSize > 0 {
+		input.MaxKeys = aws.Int64(int64(opts.PageSize))
+	}
+
+	errCh := make(chan error, 1)
+	err = s3c.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, last bool) bool {
 		for _, obj := range page.Contents {
-			if err := fn(*obj.Key); err != nil {
+			if err := fn(ObjectInfo{
+				Name:         aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				ModTime:      aws.TimeValue(obj.LastModified),
+				ETag:         aws.StringValue(obj.ETag),
+				StorageClass: aws.StringValue(obj.StorageClass),
+			}); err != nil {
+				errCh <- err
+				return false
+			}
+		}
+		// CommonPrefixes holds the "directories" grouped by Delimiter; emit
+		// them alongside Contents so Delimiter listings behave the same way
+		// as CloudStorage's.
+		for _, cp := range page.CommonPrefixes {
+			if err := fn(ObjectInfo{Name: aws.StringValue(cp.Prefix), IsPrefix: true}); err != nil {
 				errCh <- err
 				return false
 			}
@@ -93,33 +366,178 @@ func (s *S3) Walk(ctx context.Context, path string, fn WalkFn) error {
 	return <-errCh
 }
 
+// Copy implements FS using S3's server-side CopyObject, which copies the
+// object without routing its bytes through this process. Objects larger than
+// s3CopyObjectMaxSize are copied with a multipart UploadPartCopy instead,
+// since CopyObject rejects them.
+func (s *S3) Copy(ctx context.Context, src, dst string) error {
+	_, s3c, err := s.bucketHandles(ctx)
+	if err != nil {
+		return err
+	}
+
+	head, err := s3c.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(src),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: unable to stat %q: %v", src, err)
+	}
+
+	if aws.Int64Value(head.ContentLength) > s3CopyObjectMaxSize {
+		return s.multipartCopy(ctx, s3c, src, dst, aws.Int64Value(head.ContentLength))
+	}
+
+	_, err = s3c.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.Bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(s.copySource(src)),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: unable to copy %q to %q: %v", src, dst, err)
+	}
+	return nil
+}
+
+// Move implements FS by copying src to dst and then deleting src.
+func (s *S3) Move(ctx context.Context, src, dst string) error {
+	if err := s.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	return s.Delete(ctx, src)
+}
+
+// multipartCopy copies an object too large for a single CopyObject call by
+// issuing a series of UploadPartCopy calls, each covering up to
+// s3CopyObjectMaxSize bytes of the source, and completing them as a single
+// multipart object.
+func (s *S3) multipartCopy(ctx context.Context, s3c *s3.S3, src, dst string, size int64) error {
+	create, err := s3c.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(dst),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: unable to start multipart copy of %q: %v", src, err)
+	}
+
+	abort := func() {
+		s3c.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.Bucket),
+			Key:      aws.String(dst),
+			UploadId: create.UploadId,
+		})
+	}
+
+	var parts []*s3.CompletedPart
+	for partNumber, offset := int64(1), int64(0); offset < size; partNumber, offset = partNumber+1, offset+s3CopyObjectMaxSize {
+		end := offset + s3CopyObjectMaxSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		out, err := s3c.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.Bucket),
+			Key:             aws.String(dst),
+			CopySource:      aws.String(s.copySource(src)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			PartNumber:      aws.Int64(partNumber),
+			UploadId:        create.UploadId,
+		})
+		if err != nil {
+			abort()
+			return fmt.Errorf("s3: unable to copy part %d of %q: %v", partNumber, src, err)
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int64(partNumber),
+		})
+	}
+
+	_, err = s3c.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(dst),
+		UploadId:        create.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abort()
+		return fmt.Errorf("s3: unable to complete multipart copy of %q: %v", src, err)
+	}
+	return nil
+}
+
+// copySource builds the CopySource value expected by CopyObject and
+// UploadPartCopy: the bucket and key, path-escaped so that "/" is preserved
+// between them and a space becomes "%20" rather than "+" (S3 decodes
+// CopySource with path semantics, not query semantics, so QueryEscape would
+// corrupt keys containing spaces or literal "+").
+func (s *S3) copySource(key string) string {
+	u := url.URL{Path: s.Bucket + "/" + key}
+	return u.EscapedPath()
+}
+
 const bucketRegionHint = endpoints.UsEast1RegionID
 
 func (s *S3) bucketHandles(ctx context.Context) (*blob.Bucket, *s3.S3, error) {
-	sess, err := session.NewSession()
+	sess, c, err := s.awsConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	sess = sess.Copy(c)
+
+	b, err := s3blob.OpenBucket(ctx, sess, s.Bucket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3: could not open %q: %v", s.Bucket, err)
+	}
+	s3c := s3.New(sess, c)
+
+	return b, s3c, nil
+}
+
+// awsConfig builds the session and config used to talk to S3 (or an
+// S3-compatible endpoint), honouring Endpoint, Region, Profile, Credentials,
+// ForcePathStyle and DisableSSL.
+func (s *S3) awsConfig(ctx context.Context) (*session.Session, *aws.Config, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{Profile: s.Profile})
 	if err != nil {
 		return nil, nil, fmt.Errorf("s3: unable to create session: %v", err)
 	}
 
-	// https://docs.aws.amazon.com/sdk-for-go/api/service/s3/s3manager/#GetBucketRegion
-	region := aws.StringValue(sess.Config.Region)
+	region := s.Region
 	if len(region) == 0 {
+		region = aws.StringValue(sess.Config.Region)
+	}
+	// Skip bucket region discovery when an explicit endpoint and/or region has
+	// been supplied: GetBucketRegion assumes AWS and will fail against
+	// S3-compatible services such as Localstack or MinIO.
+	if len(region) == 0 && len(s.Endpoint) == 0 {
 		region, err = s3manager.GetBucketRegion(ctx, sess, s.Bucket, bucketRegionHint)
 		if err != nil {
 			return nil, nil, fmt.Errorf("s3: unable to find bucket region: %v", err)
 		}
 	}
+	if len(region) == 0 {
+		region = bucketRegionHint
+	}
+
+	var awsCreds *credentials.Credentials
+	switch {
+	case s.Credentials != nil:
+		awsCreds = credentials.NewCredentials(s.Credentials)
+	case len(s.Profile) > 0:
+		awsCreds = credentials.NewSharedCredentials("", s.Profile)
+	default:
+		awsCreds = credentials.NewEnvCredentials()
+	}
 
 	c := aws.NewConfig().
 		WithRegion(region).
-		WithCredentials(credentials.NewEnvCredentials())
-	sess = sess.Copy(c)
-
-	b, err := s3blob.OpenBucket(ctx, sess, s.Bucket)
-	if err != nil {
-		return nil, nil, fmt.Errorf("s3: could not open %q: %v", s.Bucket, err)
+		WithCredentials(awsCreds).
+		WithS3ForcePathStyle(s.ForcePathStyle).
+		WithDisableSSL(s.DisableSSL)
+	if len(s.Endpoint) > 0 {
+		c = c.WithEndpoint(s.Endpoint)
 	}
-	s3 := s3.New(sess, c)
 
-	return b, s3, nil
+	return sess, c, nil
 }
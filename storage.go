@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// FS is a filesystem abstraction implemented by the various storage backends
+// supported by this package.
+type FS interface {
+	// Open opens the file at path for reading.
+	Open(ctx context.Context, path string) (*File, error)
+
+	// Create creates (or truncates) the file at path for writing. opts may be
+	// used to control how the object is written, e.g. its chunk/part size,
+	// content type and metadata; at most one may be provided.
+	Create(ctx context.Context, path string, opts ...*CreateOptions) (io.WriteCloser, error)
+
+	// Delete removes the file at path.
+	Delete(ctx context.Context, path string) error
+
+	// Walk calls fn once for every file found under path.
+	Walk(ctx context.Context, path string, fn WalkFn) error
+
+	// WalkFull calls fn once for every object found under path, passing the
+	// object's metadata rather than just its name. opts controls delimiter
+	// and pagination behaviour; a nil opts lists all objects under path
+	// recursively.
+	WalkFull(ctx context.Context, path string, opts *WalkOptions, fn ObjectInfoFn) error
+
+	// Copy copies the file at src to dst within this FS, using the backend's
+	// native server-side copy so that bytes are not round-tripped through
+	// the caller.
+	Copy(ctx context.Context, src, dst string) error
+
+	// Move is like Copy, but also removes src once the copy succeeds.
+	Move(ctx context.Context, src, dst string) error
+}
+
+// File wraps an io.ReadCloser with metadata about the underlying object.
+type File struct {
+	io.ReadCloser
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// WalkFn is the type of function called by Walk for each file found under the
+// path being walked.
+type WalkFn func(path string) error
+
+// ObjectInfo describes an object found while walking a path with WalkFull.
+// Some fields may be zero-valued if the backend's listing API doesn't
+// return them; in particular S3's ListObjects does not return ContentType.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	ModTime      time.Time
+	ETag         string
+	StorageClass string
+	ContentType  string
+
+	// IsPrefix reports that this entry is a grouped common prefix produced
+	// by WalkOptions.Delimiter (a "directory"), rather than a concrete
+	// object. Only Name is populated in that case.
+	IsPrefix bool
+}
+
+// ObjectInfoFn is the type of function called by WalkFull for each object
+// found under the path being walked.
+type ObjectInfoFn func(ObjectInfo) error
+
+// WalkOptions controls the listing behaviour of WalkFull. The zero value
+// lists every object under path, recursively.
+type WalkOptions struct {
+	// Delimiter, if set, groups keys after the prefix up to the first
+	// occurrence of Delimiter; objects nested beyond it are not visited.
+	// Passing "/" gives directory-style, single-level listings.
+	Delimiter string
+
+	// StartAfter resumes a listing lexicographically after this key,
+	// allowing pagination across multiple calls.
+	StartAfter string
+
+	// PageSize caps the number of objects requested per underlying API call.
+	// A value of 0 uses the backend's default.
+	PageSize int
+
+	// Recursive, if true, lists every object under path regardless of
+	// nesting, ignoring Delimiter. It has no effect when Delimiter is empty,
+	// since that already lists recursively.
+	Recursive bool
+}
+
+func walkOptionsOrDefault(opts *WalkOptions) *WalkOptions {
+	if opts == nil {
+		return &WalkOptions{}
+	}
+	return opts
+}
+
+// Copy copies srcPath from src to dstPath on dst. When src and dst are the
+// same FS, the backend's native Copy is used so the object never leaves the
+// storage provider; otherwise the object is streamed through Open and
+// Create, since there is no API that can copy directly between two
+// different backends.
+func Copy(ctx context.Context, dst FS, dstPath string, src FS, srcPath string) error {
+	if dst == src {
+		return dst.Copy(ctx, srcPath, dstPath)
+	}
+	return streamCopy(ctx, dst, dstPath, src, srcPath)
+}
+
+// Move is like Copy, but also deletes srcPath from src once the copy
+// succeeds.
+func Move(ctx context.Context, dst FS, dstPath string, src FS, srcPath string) error {
+	if dst == src {
+		return dst.Move(ctx, srcPath, dstPath)
+	}
+	if err := streamCopy(ctx, dst, dstPath, src, srcPath); err != nil {
+		return err
+	}
+	return src.Delete(ctx, srcPath)
+}
+
+func streamCopy(ctx context.Context, dst FS, dstPath string, src FS, srcPath string) error {
+	f, err := src.Open(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := dst.Create(ctx, dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// URLSigner is an optional capability implemented by backends that can
+// generate time-limited URLs for accessing an object directly, without
+// proxying bytes through the application.
+type URLSigner interface {
+	// SignedURL returns a URL that grants temporary access to path according
+	// to opts.
+	SignedURL(ctx context.Context, path string, opts *SignedURLOptions) (string, error)
+}
+
+// SignedURLOptions controls the URL generated by a URLSigner.
+type SignedURLOptions struct {
+	// Method is the HTTP method the URL grants access for, e.g. "GET",
+	// "PUT" or "DELETE". Defaults to "GET".
+	Method string
+
+	// Expiry is how long the URL remains valid for. Defaults to 15 minutes.
+	Expiry time.Duration
+
+	// ContentType, if set, restricts a "PUT" URL to uploads of this content
+	// type.
+	ContentType string
+
+	// ResponseContentDisposition, if set, overrides the Content-Disposition
+	// response header returned when the URL is used.
+	ResponseContentDisposition string
+
+	// ResponseContentType, if set, overrides the Content-Type response
+	// header returned when the URL is used.
+	ResponseContentType string
+}
+
+const defaultSignedURLExpiry = 15 * time.Minute
+
+func signedURLOptionsOrDefault(opts *SignedURLOptions) SignedURLOptions {
+	var o SignedURLOptions
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.Method) == 0 {
+		o.Method = "GET"
+	}
+	if o.Expiry <= 0 {
+		o.Expiry = defaultSignedURLExpiry
+	}
+	return o
+}
+
+// CreateOptions controls how an object is written by Create. The zero value
+// is valid and lets the backend choose its own defaults.
+type CreateOptions struct {
+	// ChunkSize is the size, in bytes, of each part/chunk uploaded to the
+	// backend. For S3 this is used as the s3manager.Uploader PartSize; for GCS
+	// it is used as the writer's ChunkSize. A value of 0 uses the backend's
+	// default.
+	ChunkSize int
+
+	// Concurrency is the number of parts uploaded in parallel. A value of 0
+	// uses the backend's default.
+	Concurrency int
+
+	// ContentType is the MIME type of the object being written.
+	ContentType string
+
+	// Metadata is a set of user-defined key-value pairs stored alongside the
+	// object.
+	Metadata map[string]string
+
+	// CacheControl sets the Cache-Control header/attribute of the object.
+	CacheControl string
+
+	// ContentEncoding sets the Content-Encoding header/attribute of the
+	// object.
+	ContentEncoding string
+}
+
+func firstCreateOptions(opts []*CreateOptions) *CreateOptions {
+	for _, o := range opts {
+		if o != nil {
+			return o
+		}
+	}
+	return &CreateOptions{}
+}
+
+// DownloadOptions controls how an object is fetched by a backend's Download
+// method. The zero value is valid and lets the backend choose its own
+// defaults.
+type DownloadOptions struct {
+	// ChunkSize is the size, in bytes, of each ranged GET issued while
+	// downloading the object. A value of 0 uses the backend's default.
+	ChunkSize int
+
+	// Concurrency is the number of ranged GETs issued in parallel. A value of
+	// 0 uses the backend's default.
+	Concurrency int
+}
+
+func firstDownloadOptions(opts []*DownloadOptions) *DownloadOptions {
+	for _, o := range opts {
+		if o != nil {
+			return o
+		}
+	}
+	return &DownloadOptions{}
+}
+
+// notExistError is returned by Open when the requested path does not exist.
+type notExistError struct {
+	Path string
+}
+
+func (e *notExistError) Error() string {
+	return fmt.Sprintf("storage: %q does not exist", e.Path)
+}
+
+// IsNotExist reports whether err indicates that a file does not exist.
+func IsNotExist(err error) bool {
+	_, ok := err.(*notExistError)
+	return ok
+}